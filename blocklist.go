@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// wildcardNode is a node in a suffix trie keyed by reversed domain labels,
+// e.g. "*.doubleclick.net" is stored as net -> doubleclick (terminal). Any
+// query whose labels pass through a terminal node is considered blocked,
+// which covers the base domain and all of its subdomains.
+type wildcardNode struct {
+	children map[string]*wildcardNode
+	terminal bool
+}
+
+// Blocklist holds compiled exact-match and wildcard blocklist rules plus a
+// running count of blocked/allowed decisions for future reporting.
+type Blocklist struct {
+	mode string // "zero" or "nxdomain"
+
+	exact    map[string]struct{}
+	wildcard *wildcardNode
+
+	blocked uint64
+	allowed uint64
+}
+
+func newBlocklist(mode string) *Blocklist {
+	if mode == "" {
+		mode = "zero"
+	}
+	return &Blocklist{
+		mode:     mode,
+		exact:    make(map[string]struct{}),
+		wildcard: &wildcardNode{children: make(map[string]*wildcardNode)},
+	}
+}
+
+// Mode returns the configured block response mode: "zero" (return 0.0.0.0/::)
+// or "nxdomain".
+func (b *Blocklist) Mode() string { return b.mode }
+
+func (b *Blocklist) addExact(domain string) {
+	b.exact[normalizeDomain(domain)] = struct{}{}
+}
+
+func (b *Blocklist) addWildcard(domain string) {
+	labels := reversedLabels(normalizeDomain(domain))
+	node := b.wildcard
+	for _, label := range labels {
+		child, ok := node.children[label]
+		if !ok {
+			child = &wildcardNode{children: make(map[string]*wildcardNode)}
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.terminal = true
+}
+
+// Blocked reports whether qname matches an exact or wildcard blocklist rule.
+func (b *Blocklist) Blocked(qname string) bool {
+	name := normalizeDomain(qname)
+	if _, ok := b.exact[name]; ok {
+		return true
+	}
+
+	node := b.wildcard
+	for _, label := range reversedLabels(name) {
+		child, ok := node.children[label]
+		if !ok {
+			return false
+		}
+		if child.terminal {
+			return true
+		}
+		node = child
+	}
+	return false
+}
+
+// IncBlocked and IncAllowed update the stats counters; Stats reports them.
+func (b *Blocklist) IncBlocked() { atomic.AddUint64(&b.blocked, 1) }
+func (b *Blocklist) IncAllowed() { atomic.AddUint64(&b.allowed, 1) }
+
+// Stats returns the number of blocked and allowed queries seen so far.
+func (b *Blocklist) Stats() (blocked, allowed uint64) {
+	return atomic.LoadUint64(&b.blocked), atomic.LoadUint64(&b.allowed)
+}
+
+func normalizeDomain(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func reversedLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// LoadBlocklistDir walks dir recursively (any error aborts the load, matching
+// the repo's filepath.Walk config-loading convention) and compiles every line
+// of every file it finds into a Blocklist. Two line formats are recognized:
+// hosts-format ("0.0.0.0 evil.example") and wildcard/plain rules
+// ("*.doubleclick.net" or "evil.example"). Comments ('#') and blank lines
+// are skipped.
+func LoadBlocklistDir(dir, mode string) (*Blocklist, error) {
+	b := newBlocklist(mode)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return loadBlocklistFile(b, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func loadBlocklistFile(b *Blocklist, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if idx := strings.IndexByte(line, '#'); idx != -1 {
+			line = strings.TrimSpace(line[:idx])
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+			// Hosts-format: "<ip> <domain>".
+			b.addExact(fields[1])
+			continue
+		}
+
+		rule := fields[0]
+		if strings.HasPrefix(rule, "*.") {
+			b.addWildcard(strings.TrimPrefix(rule, "*."))
+		} else {
+			b.addExact(rule)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestBlocklistBlocked(t *testing.T) {
+	b := newBlocklist("zero")
+	b.addExact("evil.example")
+	b.addWildcard("doubleclick.net")
+
+	cases := []struct {
+		name  string
+		qname string
+		want  bool
+	}{
+		{"exact match", "evil.example.", true},
+		{"exact match is case-insensitive", "EVIL.example.", true},
+		{"wildcard matches base domain", "doubleclick.net.", true},
+		{"wildcard matches subdomain", "ads.doubleclick.net.", true},
+		{"wildcard matches nested subdomain", "a.b.doubleclick.net.", true},
+		{"unrelated domain is allowed", "example.com.", false},
+		{"suffix collision is not a match", "notdoubleclick.net.", false},
+		{"sibling label is not a match", "evil.example.com.", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := b.Blocked(tc.qname); got != tc.want {
+				t.Errorf("Blocked(%q) = %v, want %v", tc.qname, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBlocklistMode(t *testing.T) {
+	if got := newBlocklist("").Mode(); got != "zero" {
+		t.Errorf("Mode() with empty config = %q, want %q (default)", got, "zero")
+	}
+	if got := newBlocklist("nxdomain").Mode(); got != "nxdomain" {
+		t.Errorf("Mode() = %q, want %q", got, "nxdomain")
+	}
+}
+
+func TestBlocklistStats(t *testing.T) {
+	b := newBlocklist("zero")
+	b.addExact("evil.example")
+
+	b.IncAllowed()
+	if b.Blocked("evil.example.") {
+		b.IncBlocked()
+	}
+	b.IncAllowed()
+
+	blocked, allowed := b.Stats()
+	if blocked != 1 || allowed != 2 {
+		t.Errorf("Stats() = (blocked=%d, allowed=%d), want (1, 2)", blocked, allowed)
+	}
+}
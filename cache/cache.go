@@ -0,0 +1,227 @@
+// Package cache implements a bounded, in-memory DNS response cache with
+// TTL honoring (RFC 1035) and negative caching (RFC 2308), sitting between
+// the DNS handler and the upstream resolvers.
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Key uniquely identifies a cached query.
+type Key struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+}
+
+// KeyFor builds a cache Key from a DNS question.
+func KeyFor(q dns.Question) Key {
+	return Key{
+		Name:   strings.ToLower(q.Name),
+		Qtype:  q.Qtype,
+		Qclass: q.Qclass,
+	}
+}
+
+type entry struct {
+	key     Key
+	msg     *dns.Msg
+	expires time.Time
+}
+
+// Cache is a size-bounded, LRU-evicted cache of *dns.Msg answers keyed by
+// query name/type/class. It is safe for concurrent use.
+type Cache struct {
+	MinTTL         time.Duration
+	MaxTTL         time.Duration
+	MaxNegativeTTL time.Duration
+
+	mu    sync.Mutex
+	size  int
+	items map[Key]*list.Element // values are *entry wrapped in list.Element
+	order *list.List            // most-recently-used at the front
+}
+
+// New creates a Cache holding at most size entries. minTTL/maxTTL clamp the
+// TTL of every cached answer; maxNegativeTTL first caps the SOA-MINIMUM-derived
+// TTL of cached NXDOMAIN/NODATA answers, before that clamp is applied.
+func New(size int, minTTL, maxTTL, maxNegativeTTL time.Duration) *Cache {
+	return &Cache{
+		MinTTL:         minTTL,
+		MaxTTL:         maxTTL,
+		MaxNegativeTTL: maxNegativeTTL,
+		size:           size,
+		items:          make(map[Key]*list.Element),
+		order:          list.New(),
+	}
+}
+
+// Get returns a cached reply for key, with remaining TTLs decremented to
+// reflect how long the entry has sat in the cache. ok is false on a miss or
+// an expired entry.
+func (c *Cache) Get(key Key) (msg *dns.Msg, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.items[key]
+	if !found {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+
+	remaining := time.Until(e.expires)
+	if remaining <= 0 {
+		c.removeElement(el)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return ageMsg(e.msg, remaining), true
+}
+
+// Set stores msg under key, computing its TTL from the answer itself
+// (positive answers) or from the SOA MINIMUM capped by MaxNegativeTTL
+// (negative answers), then clamped by MinTTL/MaxTTL. A zero or negative TTL means
+// the response is not cacheable and Set is a no-op.
+func (c *Cache) Set(key Key, msg *dns.Msg) {
+	ttl := ttlFor(msg, c.MinTTL, c.MaxTTL, c.MaxNegativeTTL)
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, found := c.items[key]; found {
+		el.Value.(*entry).msg = msg.Copy()
+		el.Value.(*entry).expires = time.Now().Add(ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+
+	e := &entry{key: key, msg: msg.Copy(), expires: time.Now().Add(ttl)}
+	el := c.order.PushFront(e)
+	c.items[key] = el
+
+	for c.order.Len() > c.size {
+		c.removeOldest()
+	}
+}
+
+// Sweep removes all expired entries. It is meant to be called periodically
+// from a background goroutine so that memory for entries nobody asks for
+// again doesn't linger until eviction.
+func (c *Cache) Sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if e := el.Value.(*entry); now.After(e.expires) {
+			c.removeElement(el)
+		}
+		el = prev
+	}
+}
+
+// StartSweeper runs Sweep every interval until stop is closed.
+func (c *Cache) StartSweeper(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Sweep()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *Cache) removeOldest() {
+	el := c.order.Back()
+	if el != nil {
+		c.removeElement(el)
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	e := el.Value.(*entry)
+	delete(c.items, e.key)
+	c.order.Remove(el)
+}
+
+// ttlFor computes the cache TTL for msg. Positive answers use the minimum
+// TTL across Answer/Ns/Extra records; negative answers (NXDOMAIN/NODATA)
+// use the SOA MINIMUM field from the Authority section, per RFC 2308.
+func ttlFor(msg *dns.Msg, minTTL, maxTTL, maxNegativeTTL time.Duration) time.Duration {
+	if msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0) {
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := time.Duration(soa.Minttl) * time.Second
+				if maxNegativeTTL > 0 && ttl > maxNegativeTTL {
+					ttl = maxNegativeTTL
+				}
+				return clampTTL(ttl, minTTL, maxTTL)
+			}
+		}
+		return 0
+	}
+
+	if msg.Rcode != dns.RcodeSuccess {
+		return 0
+	}
+
+	var min uint32
+	found := false
+	for _, set := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range set {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl := rr.Header().Ttl
+			if !found || ttl < min {
+				min = ttl
+				found = true
+			}
+		}
+	}
+	if !found {
+		return 0
+	}
+	return clampTTL(time.Duration(min)*time.Second, minTTL, maxTTL)
+}
+
+func clampTTL(ttl, minTTL, maxTTL time.Duration) time.Duration {
+	if minTTL > 0 && ttl < minTTL {
+		ttl = minTTL
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+// ageMsg returns a copy of msg with every record's TTL reduced to at most
+// remaining, so that TTLs served from cache reflect the time actually left
+// rather than the value at insertion.
+func ageMsg(msg *dns.Msg, remaining time.Duration) *dns.Msg {
+	out := msg.Copy()
+	age := uint32(remaining.Round(time.Second).Seconds())
+	for _, set := range [][]dns.RR{out.Answer, out.Ns, out.Extra} {
+		for _, rr := range set {
+			if rr.Header().Ttl > age {
+				rr.Header().Ttl = age
+			}
+		}
+	}
+	return out
+}
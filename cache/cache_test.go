@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("dns.NewRR(%q): %v", s, err)
+	}
+	return rr
+}
+
+func TestTTLFor(t *testing.T) {
+	cases := []struct {
+		name           string
+		msg            func(t *testing.T) *dns.Msg
+		minTTL         time.Duration
+		maxTTL         time.Duration
+		maxNegativeTTL time.Duration
+		want           time.Duration
+	}{
+		{
+			name: "positive answer uses minimum TTL across records",
+			msg: func(t *testing.T) *dns.Msg {
+				return &dns.Msg{
+					MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess},
+					Answer: []dns.RR{
+						mustRR(t, "foo.local. 300 IN A 10.0.0.1"),
+						mustRR(t, "foo.local. 60 IN A 10.0.0.2"),
+					},
+				}
+			},
+			want: 60 * time.Second,
+		},
+		{
+			name: "positive answer ignores OPT when computing minimum",
+			msg: func(t *testing.T) *dns.Msg {
+				opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Ttl: 0}}
+				return &dns.Msg{
+					MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess},
+					Answer: []dns.RR{mustRR(t, "foo.local. 120 IN A 10.0.0.1")},
+					Extra:  []dns.RR{opt},
+				}
+			},
+			want: 120 * time.Second,
+		},
+		{
+			name:   "positive answer TTL clamped to MinTTL/MaxTTL",
+			minTTL: 30 * time.Second,
+			maxTTL: 90 * time.Second,
+			msg: func(t *testing.T) *dns.Msg {
+				return &dns.Msg{
+					MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess},
+					Answer: []dns.RR{mustRR(t, "foo.local. 5 IN A 10.0.0.1")},
+				}
+			},
+			want: 30 * time.Second,
+		},
+		{
+			name:           "NXDOMAIN uses SOA MINIMUM from authority, clamped by MaxNegativeTTL",
+			maxNegativeTTL: 60 * time.Second,
+			msg: func(t *testing.T) *dns.Msg {
+				return &dns.Msg{
+					MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError},
+					Ns:     []dns.RR{mustRR(t, "local. 3600 IN SOA ns.local. hostmaster.local. 1 3600 600 86400 300")},
+				}
+			},
+			want: 60 * time.Second,
+		},
+		{
+			name: "NODATA (success, empty answer) uses SOA MINIMUM",
+			msg: func(t *testing.T) *dns.Msg {
+				return &dns.Msg{
+					MsgHdr: dns.MsgHdr{Rcode: dns.RcodeSuccess},
+					Ns:     []dns.RR{mustRR(t, "local. 3600 IN SOA ns.local. hostmaster.local. 1 3600 600 86400 120")},
+				}
+			},
+			want: 120 * time.Second,
+		},
+		{
+			name: "negative answer with no SOA in authority is not cacheable",
+			msg: func(t *testing.T) *dns.Msg {
+				return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}
+			},
+			want: 0,
+		},
+		{
+			name: "SERVFAIL is not cacheable",
+			msg: func(t *testing.T) *dns.Msg {
+				return &dns.Msg{
+					MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure},
+					Answer: []dns.RR{mustRR(t, "foo.local. 300 IN A 10.0.0.1")},
+				}
+			},
+			want: 0,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ttlFor(tc.msg(t), tc.minTTL, tc.maxTTL, tc.maxNegativeTTL)
+			if got != tc.want {
+				t.Errorf("ttlFor() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAgeMsg(t *testing.T) {
+	msg := &dns.Msg{
+		Answer: []dns.RR{mustRR(t, "foo.local. 300 IN A 10.0.0.1")},
+		Ns:     []dns.RR{mustRR(t, "foo.local. 10 IN NS ns.local.")},
+	}
+
+	aged := ageMsg(msg, 30*time.Second)
+
+	if got := aged.Answer[0].Header().Ttl; got != 30 {
+		t.Errorf("Answer TTL = %d, want 30 (capped to remaining)", got)
+	}
+	if got := aged.Ns[0].Header().Ttl; got != 10 {
+		t.Errorf("Ns TTL = %d, want 10 (already below remaining, left unchanged)", got)
+	}
+	if got := msg.Answer[0].Header().Ttl; got != 300 {
+		t.Errorf("ageMsg mutated the original message's TTL: got %d, want 300", got)
+	}
+}
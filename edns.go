@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const defaultEDNSUDPSize = 1232 // DNS Flag Day 2020 recommendation
+
+// attachEDNS0 adds a fresh OPT record, sized per cfg.UDPSize, to qMsg
+// before it's sent upstream. If the client's original query carried an OPT
+// record (reqOPT), its DO bit and non-ECS options are copied into it; the
+// client's advertised UDP size is not. When cfg.ClientSubnet is enabled, an
+// EDNS0 Client Subnet option (RFC 7871) derived from remoteAddr is appended.
+func attachEDNS0(qMsg *dns.Msg, reqOPT *dns.OPT, remoteAddr net.Addr, cfg EDNSConfig) {
+	udpSize := cfg.UDPSize
+	if udpSize == 0 {
+		udpSize = defaultEDNSUDPSize
+	}
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(udpSize)
+
+	if reqOPT != nil {
+		opt.SetDo(reqOPT.Do())
+		for _, o := range reqOPT.Option {
+			if _, isECS := o.(*dns.EDNS0_SUBNET); isECS {
+				continue // replaced below if client_subnet is enabled
+			}
+			opt.Option = append(opt.Option, o)
+		}
+	}
+
+	if cfg.ClientSubnet.Enabled {
+		if ecs := buildECS(remoteAddr, cfg.ClientSubnet); ecs != nil {
+			opt.Option = append(opt.Option, ecs)
+		}
+	}
+
+	qMsg.Extra = append(qMsg.Extra, opt)
+}
+
+// stripOPT removes any OPT pseudo-record from rrs. OPT is hop-by-hop
+// (RFC 6891): an upstream reply's OPT describes that hop, not the one
+// between the proxy and its client, so it must not be forwarded or cached
+// as-is. handleDNSRequest attaches its own single OPT for the client.
+func stripOPT(rrs []dns.RR) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			out = append(out, rr)
+		}
+	}
+	return out
+}
+
+// buildECS derives an EDNS0 Client Subnet option from remoteAddr, truncated
+// to the configured IPv4/IPv6 prefix length.
+func buildECS(remoteAddr net.Addr, cfg ClientSubnetConfig) *dns.EDNS0_SUBNET {
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		host = remoteAddr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		prefix := cfg.IPv4Prefix
+		if prefix <= 0 || prefix > 32 {
+			prefix = 24
+		}
+		e.Family = 1
+		e.SourceNetmask = uint8(prefix)
+		e.Address = ip4.Mask(net.CIDRMask(prefix, 32))
+		return e
+	}
+
+	prefix := cfg.IPv6Prefix
+	if prefix <= 0 || prefix > 128 {
+		prefix = 56
+	}
+	e.Family = 2
+	e.SourceNetmask = uint8(prefix)
+	e.Address = ip.Mask(net.CIDRMask(prefix, 128))
+	return e
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/miekg/dns"
 	"gopkg.in/yaml.v3"
+
+	"simple-dns-proxy/cache"
 )
 
 type ServerConfig struct {
@@ -19,9 +25,87 @@ type ServerConfig struct {
 	Interface string `yaml:"interface"`
 }
 
+type CacheConfig struct {
+	Enabled        bool `yaml:"enabled"`
+	Size           int  `yaml:"size"`
+	MinTTL         int  `yaml:"min_ttl"`
+	MaxTTL         int  `yaml:"max_ttl"`
+	MaxNegativeTTL int  `yaml:"max_negative_ttl"`
+}
+
+type BlocklistConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	Mode    string `yaml:"mode"` // "zero" (default) or "nxdomain"
+}
+
+type RateLimitConfig struct {
+	Enabled bool    `yaml:"enabled"`
+	QPS     float64 `yaml:"qps"`
+	Burst   int     `yaml:"burst"`
+}
+
+type QueryLogConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	File       string `yaml:"file"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+type HandlerConfig struct {
+	MaxConcurrency int `yaml:"max_concurrency"`
+}
+
+type FallbackConfig struct {
+	ParallelCount int `yaml:"parallel_count"`
+}
+
+type ClientSubnetConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	IPv4Prefix int  `yaml:"ipv4_prefix"`
+	IPv6Prefix int  `yaml:"ipv6_prefix"`
+}
+
+type EDNSConfig struct {
+	UDPSize      uint16             `yaml:"udp_size"`
+	ClientSubnet ClientSubnetConfig `yaml:"client_subnet"`
+}
+
+// RecordEntry is one typed resource record served for a zone name. Value
+// holds the record's primary data (an address for A/AAAA, a target name
+// for CNAME/MX/SRV/PTR, free text for TXT); Priority is used by MX (as the
+// preference) and SRV, and Weight/Port only by SRV. TTL defaults to
+// defaultRecordTTL when zero.
+type RecordEntry struct {
+	Type     string `yaml:"type"`
+	Value    string `yaml:"value"`
+	TTL      int    `yaml:"ttl"`
+	Priority uint16 `yaml:"priority"` // MX preference, SRV priority
+	Weight   uint16 `yaml:"weight"`   // SRV
+	Port     uint16 `yaml:"port"`     // SRV
+}
+
+// RecordsConfig is the "records" section of config.yaml: Zones maps a
+// domain name to the typed records served for it, and AutoPTR, when set,
+// additionally synthesizes a PTR record under in-addr.arpa/ip6.arpa for
+// every configured A/AAAA value.
+type RecordsConfig struct {
+	AutoPTR bool                     `yaml:"auto_ptr"`
+	Zones   map[string][]RecordEntry `yaml:",inline"`
+}
+
 type Config struct {
-	Records     map[string]string `yaml:"records"`
-	FallbackDNS string            `yaml:"fallback_dns"`
+	Records     RecordsConfig   `yaml:"records"`
+	FallbackDNS []string        `yaml:"fallback_dns"`
+	Bootstrap   string          `yaml:"bootstrap"`
+	Cache       CacheConfig     `yaml:"cache"`
+	Blocklist   BlocklistConfig `yaml:"blocklist"`
+	RateLimit   RateLimitConfig `yaml:"ratelimit"`
+	RefuseAny   bool            `yaml:"refuse_any"`
+	QueryLog    QueryLogConfig  `yaml:"querylog"`
+	Handler     HandlerConfig   `yaml:"handler"`
+	Fallback    FallbackConfig  `yaml:"fallback"`
+	EDNS        EDNSConfig      `yaml:"edns"`
 	Server      struct {
 		UDP ServerConfig `yaml:"udp"`
 		TCP ServerConfig `yaml:"tcp"`
@@ -33,6 +117,35 @@ var (
 	configLock        sync.RWMutex
 	configFile        string                      // Will be set in init()
 	defaultConfigPath = "/app/config/config.yaml" // Default path inside the container
+
+	upstreams     []Upstream
+	upstreamsLock sync.RWMutex
+	rrCounter     uint64
+
+	dnsCache         *cache.Cache
+	dnsCacheLock     sync.RWMutex
+	cacheSweeperStop chan struct{}
+
+	blocklistState     *Blocklist
+	blocklistLock      sync.RWMutex
+	blocklistWatchStop chan struct{}
+
+	limiter            *RateLimiter
+	limiterLock        sync.RWMutex
+	limiterSweeperStop chan struct{}
+
+	queryLogger     *QueryLogger
+	queryLoggerLock sync.RWMutex
+
+	recordStore     *RecordStore
+	recordStoreLock sync.RWMutex
+)
+
+const (
+	defaultCacheSweepInterval    = 1 * time.Minute
+	rateLimiterSweepInterval     = 1 * time.Minute
+	rateLimiterBucketIdleTimeout = 10 * time.Minute
+	minUDPMsgSize                = 512 // RFC 1035 minimum, used with no EDNS0
 )
 
 // init finds and sets the config file path
@@ -86,10 +199,20 @@ func loadConfig() error {
 	if config.Server.TCP.Port <= 0 {
 		config.Server.TCP.Port = 53
 	}
+	if config.EDNS.UDPSize == 0 {
+		config.EDNS.UDPSize = defaultEDNSUDPSize
+	}
 
 	log.Println("Configuration loaded/reloaded")
 	log.Printf("Records: %v", config.Records)
-	log.Printf("Fallback DNS: %s", config.FallbackDNS)
+	log.Printf("Fallback DNS: %v", config.FallbackDNS)
+
+	buildUpstreams(newConfig.FallbackDNS, newConfig.Bootstrap)
+	buildCache(newConfig.Cache)
+	buildBlocklist(newConfig.Blocklist)
+	buildRateLimiter(newConfig.RateLimit)
+	buildQueryLogger(newConfig.QueryLog)
+	buildRecords(newConfig.Records)
 
 	// Log server configuration
 	log.Printf("UDP Server: enabled=%v, port=%d, interface=%q",
@@ -100,6 +223,222 @@ func loadConfig() error {
 	return nil
 }
 
+// buildUpstreams resolves each configured fallback_dns address into an
+// Upstream and swaps them into the global upstreams slice. Addresses that
+// fail to parse are logged and skipped rather than aborting the reload.
+func buildUpstreams(addrs []string, bootstrap string) {
+	built := make([]Upstream, 0, len(addrs))
+	for _, addr := range addrs {
+		u, err := AddressToUpstream(addr, bootstrap)
+		if err != nil {
+			log.Printf("Skipping invalid fallback_dns entry %q: %v", addr, err)
+			continue
+		}
+		built = append(built, u)
+	}
+
+	upstreamsLock.Lock()
+	upstreams = built
+	upstreamsLock.Unlock()
+}
+
+// buildCache (re)creates the response cache from CacheConfig. If caching is
+// disabled, any existing cache and its sweeper are torn down.
+func buildCache(cfg CacheConfig) {
+	dnsCacheLock.Lock()
+	defer dnsCacheLock.Unlock()
+
+	if cacheSweeperStop != nil {
+		close(cacheSweeperStop)
+		cacheSweeperStop = nil
+	}
+
+	if !cfg.Enabled {
+		dnsCache = nil
+		return
+	}
+
+	size := cfg.Size
+	if size <= 0 {
+		size = 10000
+	}
+
+	c := cache.New(
+		size,
+		time.Duration(cfg.MinTTL)*time.Second,
+		time.Duration(cfg.MaxTTL)*time.Second,
+		time.Duration(cfg.MaxNegativeTTL)*time.Second,
+	)
+	cacheSweeperStop = make(chan struct{})
+	c.StartSweeper(defaultCacheSweepInterval, cacheSweeperStop)
+	dnsCache = c
+}
+
+// buildBlocklist (re)loads the blocklist from BlocklistConfig.Dir and
+// restarts the directory watcher so that edits under list.d/ take effect
+// without a full config reload. If disabled, any existing blocklist and
+// watcher are torn down.
+func buildBlocklist(cfg BlocklistConfig) {
+	blocklistLock.Lock()
+	if blocklistWatchStop != nil {
+		close(blocklistWatchStop)
+		blocklistWatchStop = nil
+	}
+	blocklistLock.Unlock()
+
+	if !cfg.Enabled || cfg.Dir == "" {
+		blocklistLock.Lock()
+		blocklistState = nil
+		blocklistLock.Unlock()
+		return
+	}
+
+	b, err := LoadBlocklistDir(cfg.Dir, cfg.Mode)
+	if err != nil {
+		log.Printf("Failed to load blocklist dir %s: %v", cfg.Dir, err)
+		return
+	}
+
+	blocklistLock.Lock()
+	blocklistState = b
+	stop := make(chan struct{})
+	blocklistWatchStop = stop
+	blocklistLock.Unlock()
+
+	log.Printf("Loaded blocklist from %s (mode=%s)", cfg.Dir, b.Mode())
+	go watchBlocklistDir(cfg.Dir, cfg.Mode, stop)
+}
+
+// watchBlocklistDir reloads the blocklist whenever files under dir change,
+// mirroring the fsnotify pattern used by watchConfig.
+func watchBlocklistDir(dir, mode string, stop <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to create blocklist watcher: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(dir); err != nil {
+		log.Printf("Failed to watch blocklist directory %s: %v", dir, err)
+		return
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) ||
+				event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				log.Printf("Blocklist directory event: %s, reloading", event)
+				b, err := LoadBlocklistDir(dir, mode)
+				if err != nil {
+					log.Printf("Error reloading blocklist: %v. Keeping previous rules.", err)
+					continue
+				}
+				blocklistLock.Lock()
+				blocklistState = b
+				blocklistLock.Unlock()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching blocklist directory: %v", err)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// buildRateLimiter (re)creates the rate limiter from RateLimitConfig. If
+// disabled, any existing limiter and its sweeper are torn down so queries
+// flow through unrestricted.
+func buildRateLimiter(cfg RateLimitConfig) {
+	limiterLock.Lock()
+	defer limiterLock.Unlock()
+
+	if limiterSweeperStop != nil {
+		close(limiterSweeperStop)
+		limiterSweeperStop = nil
+	}
+
+	if !cfg.Enabled || cfg.QPS <= 0 {
+		limiter = nil
+		return
+	}
+
+	l := NewRateLimiter(cfg.QPS, cfg.Burst)
+	limiterSweeperStop = make(chan struct{})
+	l.StartSweeper(rateLimiterSweepInterval, rateLimiterBucketIdleTimeout, limiterSweeperStop)
+	limiter = l
+}
+
+// buildRecords (re)compiles the static record store from RecordsConfig,
+// synthesizing PTR entries when cfg.AutoPTR is set. An empty Zones map
+// still produces an (empty) store so a reload that removes all records
+// takes effect.
+func buildRecords(cfg RecordsConfig) {
+	s := BuildRecordStore(cfg)
+
+	recordStoreLock.Lock()
+	recordStore = s
+	recordStoreLock.Unlock()
+}
+
+// buildQueryLogger (re)opens the query logger from QueryLogConfig, flushing
+// and closing any previous logger first so that in-flight records for the
+// old file aren't lost across a config reload.
+func buildQueryLogger(cfg QueryLogConfig) {
+	queryLoggerLock.Lock()
+	defer queryLoggerLock.Unlock()
+
+	if queryLogger != nil {
+		if err := queryLogger.Close(); err != nil {
+			log.Printf("Error closing previous query log: %v", err)
+		}
+		queryLogger = nil
+	}
+
+	if !cfg.Enabled || cfg.File == "" {
+		return
+	}
+
+	ql, err := NewQueryLogger(cfg.File, cfg.MaxSizeMB, cfg.MaxBackups)
+	if err != nil {
+		log.Printf("Failed to start query log: %v", err)
+		return
+	}
+	queryLogger = ql
+	log.Printf("Query logging enabled, writing to %s", cfg.File)
+}
+
+// logQuery records one query-log entry if query logging is enabled.
+func logQuery(clientIP, qname, qtype, rcode, answer, upstream string, cacheHit, blocked bool, start time.Time) {
+	queryLoggerLock.RLock()
+	ql := queryLogger
+	queryLoggerLock.RUnlock()
+
+	if ql == nil {
+		return
+	}
+
+	ql.Log(QueryLogRecord{
+		Timestamp: time.Now(),
+		ClientIP:  clientIP,
+		QName:     qname,
+		QType:     qtype,
+		Rcode:     rcode,
+		Answer:    answer,
+		Upstream:  upstream,
+		ElapsedMS: float64(time.Since(start).Microseconds()) / 1000.0,
+		CacheHit:  cacheHit,
+		Blocked:   blocked,
+	})
+}
+
 func watchConfig() {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -141,65 +480,340 @@ func watchConfig() {
 	}
 }
 
-func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	msg := new(dns.Msg)
-	msg.SetReply(r)
-	msg.Authoritative = true
+// raceUpstreams picks up to parallelCount upstreams (preferring healthy
+// ones, starting from a rotating round-robin offset) and queries them
+// concurrently, returning the first successful non-SERVFAIL reply. The
+// remaining in-flight queries are canceled via ctx once a good answer
+// arrives. If every candidate errors or returns SERVFAIL, the first
+// SERVFAIL reply received is returned (or an error if none even answered).
+func raceUpstreams(r *dns.Msg, ups []Upstream, parallelCount int) (*dns.Msg, string, error) {
+	if len(ups) == 0 {
+		return nil, "", fmt.Errorf("no upstreams configured")
+	}
+	if parallelCount <= 0 {
+		parallelCount = 1
+	}
 
-	for _, q := range r.Question {
-		log.Printf("Received query for %s, type %s", q.Name, dns.TypeToString[q.Qtype])
-		// Get the fallback DNS server for potential relaying
-		configLock.RLock()
-		fallbackDNS := config.FallbackDNS
-		configLock.RUnlock()
-
-		// For A records, check if we have a match in our config first
-		if q.Qtype == dns.TypeA {
-			configLock.RLock()
-			ip, exists := config.Records[strings.ToLower(strings.TrimSuffix(q.Name, "."))]
-			configLock.RUnlock()
-
-			if exists {
-				log.Printf("Found A record for %s -> %s in config", q.Name, ip)
-				rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, ip))
-				if err == nil {
-					msg.Answer = append(msg.Answer, rr)
-					continue // Process next question
-				} else {
-					log.Printf("Error creating A record for %s: %v", q.Name, err)
-					msg.Rcode = dns.RcodeServerFailure
-					continue // Process next question
-				}
+	start := int(atomic.AddUint64(&rrCounter, 1)) % len(ups)
+	ordered := make([]Upstream, len(ups))
+	for i := range ups {
+		ordered[i] = ups[(start+i)%len(ups)]
+	}
+
+	healthy := make([]Upstream, 0, len(ordered))
+	for _, u := range ordered {
+		if !healthFor(u.Address()).inCooldown() {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		// Every upstream is in cooldown; try them anyway rather than
+		// failing the query outright.
+		healthy = ordered
+	}
+	if parallelCount > len(healthy) {
+		parallelCount = len(healthy)
+	}
+	candidates := healthy[:parallelCount]
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	type raceResult struct {
+		msg  *dns.Msg
+		addr string
+		err  error
+	}
+	results := make(chan raceResult, len(candidates))
+
+	var wg sync.WaitGroup
+	for _, u := range candidates {
+		wg.Add(1)
+		go func(u Upstream) {
+			defer wg.Done()
+			in, err := u.Exchange(ctx, r)
+			if !errors.Is(err, context.Canceled) {
+				// A canceled exchange just means a faster candidate already
+				// won the race; it says nothing about this upstream's health.
+				healthFor(u.Address()).recordResult(err == nil)
+			}
+			results <- raceResult{msg: in, addr: u.Address(), err: err}
+		}(u)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var lastErr error
+	var servfail raceResult
+	haveServfail := false
+
+	for res := range results {
+		if res.err != nil {
+			log.Printf("Upstream %s failed: %v", res.addr, res.err)
+			lastErr = res.err
+			continue
+		}
+		if res.msg.Rcode == dns.RcodeServerFailure {
+			if !haveServfail {
+				servfail = res
+				haveServfail = true
+			}
+			continue
+		}
+		cancel() // we have a good answer; stop racing the rest
+		return res.msg, res.addr, nil
+	}
+
+	if haveServfail {
+		return servfail.msg, servfail.addr, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream candidates available")
+	}
+	return nil, "", fmt.Errorf("all upstreams failed, last error: %w", lastErr)
+}
+
+// questionResult is what processQuestion hands back to handleDNSRequest for
+// merging into the final reply. Keeping this per-question, rather than
+// mutating a shared *dns.Msg directly, is what lets questions be processed
+// concurrently without one question's upstream reply clobbering another's.
+type questionResult struct {
+	rcode  int
+	answer []dns.RR
+	ns     []dns.RR
+	extra  []dns.RR
+}
+
+// processQuestion answers a single question: refuse-ANY, blocklist, static
+// records, cache, and finally relaying to the configured upstreams. reqOPT
+// and remoteAddr carry the client's original EDNS0 state so it can be
+// preserved/forwarded to the upstream relay.
+func processQuestion(q dns.Question, clientIP string, refuseAny bool, reqOPT *dns.OPT, remoteAddr net.Addr, ednsCfg EDNSConfig) questionResult {
+	qStart := time.Now()
+	qtypeStr := dns.TypeToString[q.Qtype]
+
+	if refuseAny && q.Qtype == dns.TypeANY {
+		log.Printf("Refusing ANY query for %s (RFC 8482)", q.Name)
+		hinfo := &dns.HINFO{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 60},
+			Cpu: "RFC8482",
+			Os:  "",
+		}
+		logQuery(clientIP, q.Name, qtypeStr, dns.RcodeToString[dns.RcodeSuccess], summarizeAnswer([]dns.RR{hinfo}), "", false, false, qStart)
+		return questionResult{rcode: dns.RcodeSuccess, answer: []dns.RR{hinfo}}
+	}
+
+	log.Printf("Received query for %s, type %s", q.Name, qtypeStr)
+
+	blocklistLock.RLock()
+	bl := blocklistState
+	blocklistLock.RUnlock()
+
+	if bl != nil && bl.Blocked(q.Name) {
+		bl.IncBlocked()
+		log.Printf("Blocked query for %s (%s)", q.Name, qtypeStr)
+
+		if bl.Mode() == "nxdomain" {
+			logQuery(clientIP, q.Name, qtypeStr, dns.RcodeToString[dns.RcodeNameError], "", "", false, true, qStart)
+			return questionResult{rcode: dns.RcodeNameError}
+		}
+
+		rcode := dns.RcodeSuccess
+		var answer []dns.RR
+		switch q.Qtype {
+		case dns.TypeA:
+			if rr, err := dns.NewRR(fmt.Sprintf("%s A 0.0.0.0", q.Name)); err == nil {
+				answer = []dns.RR{rr}
 			}
+		case dns.TypeAAAA:
+			if rr, err := dns.NewRR(fmt.Sprintf("%s AAAA ::", q.Name)); err == nil {
+				answer = []dns.RR{rr}
+			}
+		default:
+			rcode = dns.RcodeNameError
 		}
+		logQuery(clientIP, q.Name, qtypeStr, dns.RcodeToString[rcode], summarizeAnswer(answer), "", false, true, qStart)
+		return questionResult{rcode: rcode, answer: answer}
+	} else if bl != nil {
+		bl.IncAllowed()
+	}
+
+	// Check the static record store before the cache/upstream path: it
+	// answers any qtype configured for the name, following a CNAME chain
+	// when one is defined, before falling back.
+	recordStoreLock.RLock()
+	rs := recordStore
+	recordStoreLock.RUnlock()
+
+	if rs != nil {
+		if answer, externalTarget, ok := rs.Lookup(q.Name, q.Qtype); ok {
+			if externalTarget == "" {
+				log.Printf("Found %s record for %s in config", qtypeStr, q.Name)
+				logQuery(clientIP, q.Name, qtypeStr, dns.RcodeToString[dns.RcodeSuccess], summarizeAnswer(answer), "", false, false, qStart)
+				return questionResult{rcode: dns.RcodeSuccess, answer: answer}
+			}
 
-		// If we reach here, either:
-		// 1. It's a non-A record query
-		// 2. It's an A record query but not in our config
-		// In both cases, relay to the fallback DNS if configured
-
-		log.Printf("Relaying %s query for %s to fallback DNS %s",
-			dns.TypeToString[q.Qtype], q.Name, fallbackDNS)
-
-		if fallbackDNS == "" {
-			log.Printf("Fallback DNS not configured, returning NXDOMAIN for %s", q.Name)
-			msg.Rcode = dns.RcodeNameError // NXDOMAIN
-		} else {
-			// Relay to fallback DNS
-			c := new(dns.Client)
-			c.Net = w.RemoteAddr().Network()               // Use same protocol (UDP/TCP) as the client
-			in, _, err := c.Exchange(r, fallbackDNS+":53") // Ensure port is specified
+			// The CNAME chain steps outside the local zone (the common
+			// case of aliasing a local name to an external host); resolve
+			// the remaining name via the normal cache/upstream path and
+			// append its answer to the chain already built.
+			log.Printf("Following CNAME for %s to external name %s", q.Name, externalTarget)
+			extQ := dns.Question{Name: externalTarget, Qtype: q.Qtype, Qclass: q.Qclass}
+			rcode, extAnswer, ns, extra, usedUpstream, cacheHit, err := relayQuestion(extQ, reqOPT, remoteAddr, ednsCfg)
 			if err != nil {
-				log.Printf("Error relaying query for %s to %s: %v", q.Name, fallbackDNS, err)
-				msg.Rcode = dns.RcodeServerFailure
-			} else {
-				msg = in
+				log.Printf("Error relaying %s query for CNAME target %s: %v", qtypeStr, externalTarget, err)
+				logQuery(clientIP, q.Name, qtypeStr, dns.RcodeToString[dns.RcodeServerFailure], "", "", false, false, qStart)
+				return questionResult{rcode: dns.RcodeServerFailure}
 			}
+			full := append(answer, extAnswer...)
+			logQuery(clientIP, q.Name, qtypeStr, dns.RcodeToString[rcode], summarizeAnswer(full), usedUpstream, cacheHit, false, qStart)
+			return questionResult{rcode: rcode, answer: full, ns: ns, extra: extra}
 		}
 	}
 
-	err := w.WriteMsg(msg)
+	// If we reach here, the query didn't match a static record; check the
+	// cache, then relay to the fallback DNS if configured.
+	rcode, answer, ns, extra, usedUpstream, cacheHit, err := relayQuestion(q, reqOPT, remoteAddr, ednsCfg)
 	if err != nil {
+		log.Printf("Error relaying %s query for %s: %v", qtypeStr, q.Name, err)
+		logQuery(clientIP, q.Name, qtypeStr, dns.RcodeToString[dns.RcodeServerFailure], "", "", false, false, qStart)
+		return questionResult{rcode: dns.RcodeServerFailure}
+	}
+	logQuery(clientIP, q.Name, qtypeStr, dns.RcodeToString[rcode], summarizeAnswer(answer), usedUpstream, cacheHit, false, qStart)
+	return questionResult{rcode: rcode, answer: answer, ns: ns, extra: extra}
+}
+
+// relayQuestion answers q via the response cache or, on a miss, by racing
+// it to the configured upstreams and caching the result. It's shared by
+// the common no-local-match path and by CNAME chains that step outside the
+// local record store and need the remaining name resolved the same way.
+func relayQuestion(q dns.Question, reqOPT *dns.OPT, remoteAddr net.Addr, ednsCfg EDNSConfig) (rcode int, answer, ns, extra []dns.RR, usedUpstream string, cacheHit bool, err error) {
+	dnsCacheLock.RLock()
+	c := dnsCache
+	dnsCacheLock.RUnlock()
+
+	cacheKey := cache.KeyFor(q)
+	if c != nil {
+		if cached, hit := c.Get(cacheKey); hit {
+			log.Printf("Cache hit for %s %s", q.Name, dns.TypeToString[q.Qtype])
+			return cached.Rcode, cached.Answer, cached.Ns, cached.Extra, "", true, nil
+		}
+	}
+
+	upstreamsLock.RLock()
+	current := upstreams
+	upstreamsLock.RUnlock()
+
+	if len(current) == 0 {
+		log.Printf("Fallback DNS not configured, returning NXDOMAIN for %s", q.Name)
+		return dns.RcodeNameError, nil, nil, nil, "", false, nil
+	}
+
+	configLock.RLock()
+	parallelCount := config.Fallback.ParallelCount
+	configLock.RUnlock()
+
+	qMsg := new(dns.Msg)
+	qMsg.Id = dns.Id()
+	qMsg.RecursionDesired = true
+	qMsg.Question = []dns.Question{q}
+	attachEDNS0(qMsg, reqOPT, remoteAddr, ednsCfg)
+
+	in, usedUpstream, raceErr := raceUpstreams(qMsg, current, parallelCount)
+	if raceErr != nil {
+		return 0, nil, nil, nil, "", false, raceErr
+	}
+
+	// The upstream's OPT is hop-by-hop and must not be forwarded or cached;
+	// handleDNSRequest attaches its own OPT for the client side.
+	in.Extra = stripOPT(in.Extra)
+
+	if c != nil {
+		c.Set(cacheKey, in)
+	}
+	return in.Rcode, in.Answer, in.Ns, in.Extra, usedUpstream, false, nil
+}
+
+// processQuestionsConcurrently answers every question in r.Question through
+// a worker pool bounded by maxConcurrency (falling back to one worker per
+// question when maxConcurrency is unset), preserving question order in the
+// returned slice.
+func processQuestionsConcurrently(questions []dns.Question, clientIP string, refuseAny bool, maxConcurrency int, reqOPT *dns.OPT, remoteAddr net.Addr, ednsCfg EDNSConfig) []questionResult {
+	if maxConcurrency <= 0 || maxConcurrency > len(questions) {
+		maxConcurrency = len(questions)
+	}
+
+	results := make([]questionResult, len(questions))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+
+	for i, q := range questions {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, q dns.Question) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = processQuestion(q, clientIP, refuseAny, reqOPT, remoteAddr, ednsCfg)
+		}(i, q)
+	}
+	wg.Wait()
+	return results
+}
+
+func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+
+	limiterLock.RLock()
+	l := limiter
+	limiterLock.RUnlock()
+
+	if l != nil && !l.Allow(rateLimitKey(w.RemoteAddr())) {
+		log.Printf("Rate limit exceeded for %s, refusing query", w.RemoteAddr())
+		msg.Rcode = dns.RcodeRefused
+		if err := w.WriteMsg(msg); err != nil {
+			log.Printf("Error writing DNS response: %v", err)
+		}
+		return
+	}
+
+	configLock.RLock()
+	refuseAny := config.RefuseAny
+	maxConcurrency := config.Handler.MaxConcurrency
+	ednsCfg := config.EDNS
+	configLock.RUnlock()
+
+	clientIP := w.RemoteAddr().String()
+	reqOPT := r.IsEdns0()
+
+	results := processQuestionsConcurrently(r.Question, clientIP, refuseAny, maxConcurrency, reqOPT, w.RemoteAddr(), ednsCfg)
+	for _, res := range results {
+		msg.Answer = append(msg.Answer, res.answer...)
+		msg.Ns = append(msg.Ns, res.ns...)
+		msg.Extra = append(msg.Extra, res.extra...)
+		if res.rcode != dns.RcodeSuccess {
+			msg.Rcode = res.rcode
+		}
+	}
+
+	// Only reply with EDNS0 if the client used it, and size the response
+	// (and its OPT record) to what that client actually advertised.
+	udpSize := minUDPMsgSize
+	if reqOPT != nil {
+		if s := int(reqOPT.UDPSize()); s > udpSize {
+			udpSize = s
+		}
+		msg.SetEdns0(uint16(udpSize), reqOPT.Do())
+	}
+
+	if w.RemoteAddr().Network() == "udp" {
+		msg.Truncate(udpSize)
+	}
+
+	if err := w.WriteMsg(msg); err != nil {
 		log.Printf("Error writing DNS response: %v", err)
 	}
 }
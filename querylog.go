@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryLogRecord is a single JSON query-log entry.
+type QueryLogRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	ClientIP  string    `json:"client_ip"`
+	QName     string    `json:"qname"`
+	QType     string    `json:"qtype"`
+	Rcode     string    `json:"rcode"`
+	Answer    string    `json:"answer,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	ElapsedMS float64   `json:"elapsed_ms"`
+	CacheHit  bool      `json:"cache_hit"`
+	Blocked   bool      `json:"blocked"`
+}
+
+// QueryLogger writes one JSON record per query to a size-rotated file
+// through a buffered, non-blocking channel so that disk I/O never slows
+// down DNS handling.
+type QueryLogger struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	file *os.File
+	size int64
+
+	records chan QueryLogRecord
+	done    chan struct{}
+}
+
+// NewQueryLogger opens (creating if needed) the query log file at path and
+// starts its background writer goroutine.
+func NewQueryLogger(path string, maxSizeMB, maxBackups int) (*QueryLogger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open query log file %s: %w", path, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to stat query log file %s: %w", path, err)
+	}
+
+	q := &QueryLogger{
+		path:       path,
+		maxBytes:   int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		file:       f,
+		size:       info.Size(),
+		records:    make(chan QueryLogRecord, 1000),
+		done:       make(chan struct{}),
+	}
+	go q.run()
+	return q, nil
+}
+
+// Log enqueues rec for writing. If the internal buffer is full the record
+// is dropped rather than blocking the DNS handler.
+func (q *QueryLogger) Log(rec QueryLogRecord) {
+	select {
+	case q.records <- rec:
+	default:
+		log.Printf("Query log buffer full, dropping record for %s", rec.QName)
+	}
+}
+
+func (q *QueryLogger) run() {
+	defer close(q.done)
+	for rec := range q.records {
+		if err := q.write(rec); err != nil {
+			log.Printf("Error writing query log record: %v", err)
+		}
+	}
+}
+
+func (q *QueryLogger) write(rec QueryLogRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if q.maxBytes > 0 && q.size+int64(len(data)) > q.maxBytes {
+		if err := q.rotate(); err != nil {
+			log.Printf("Error rotating query log %s: %v", q.path, err)
+		}
+	}
+
+	n, err := q.file.Write(data)
+	q.size += int64(n)
+	return err
+}
+
+// rotate renames the current file to <path>.1 (shifting existing
+// <path>.1..<path>.N-1 up by one, dropping anything beyond maxBackups) and
+// opens a fresh file at path, matching the querylog.json/querylog.json.1
+// rotation scheme.
+func (q *QueryLogger) rotate() error {
+	if err := q.file.Close(); err != nil {
+		return err
+	}
+
+	if q.maxBackups > 0 {
+		for i := q.maxBackups; i >= 1; i-- {
+			src := fmt.Sprintf("%s.%d", q.path, i)
+			if i == q.maxBackups {
+				os.Remove(src)
+				continue
+			}
+			dst := fmt.Sprintf("%s.%d", q.path, i+1)
+			if _, err := os.Stat(src); err == nil {
+				os.Rename(src, dst)
+			}
+		}
+		if _, err := os.Stat(q.path); err == nil {
+			os.Rename(q.path, q.path+".1")
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if q.maxBackups <= 0 {
+		// No backups are kept, so the current file was not renamed away;
+		// truncate it so the reopened file really starts empty.
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(q.path, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	q.file = f
+	q.size = 0
+	return nil
+}
+
+// summarizeAnswer renders a short, single-line summary of answer records
+// for the query log's "answer" field.
+func summarizeAnswer(rrs []dns.RR) string {
+	if len(rrs) == 0 {
+		return ""
+	}
+	parts := make([]string, len(rrs))
+	for i, rr := range rrs {
+		parts[i] = rr.String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Close flushes any buffered records to disk and closes the underlying
+// file. It blocks until the writer goroutine has drained the channel.
+func (q *QueryLogger) Close() error {
+	close(q.records)
+	<-q.done
+	return q.file.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// bucket is a single client's token bucket state.
+type bucket struct {
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	touched time.Time
+}
+
+// RateLimiter is a token-bucket rate limiter keyed by an aggregated client
+// address: a /24 for IPv4 clients and a /56 for IPv6 clients, so that a
+// single client subnet can't bypass the limit by rotating addresses.
+type RateLimiter struct {
+	qps   float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewRateLimiter creates a RateLimiter allowing qps queries per second per
+// client key, with up to burst queries absorbed instantaneously.
+func NewRateLimiter(qps float64, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &RateLimiter{
+		qps:     qps,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow reports whether a query from key may proceed, consuming a token if
+// so.
+func (r *RateLimiter) Allow(key string) bool {
+	now := time.Now()
+
+	r.mu.Lock()
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.burst, last: now}
+		r.buckets[key] = b
+	}
+	r.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.touched = now
+	b.tokens += elapsed * r.qps
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Sweep removes buckets that haven't been touched in maxIdle, so that the
+// map doesn't grow without bound as clients come and go.
+func (r *RateLimiter) Sweep(maxIdle time.Duration) {
+	cutoff := time.Now().Add(-maxIdle)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, b := range r.buckets {
+		b.mu.Lock()
+		stale := b.touched.Before(cutoff)
+		b.mu.Unlock()
+		if stale {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// StartSweeper runs Sweep every interval until stop is closed.
+func (r *RateLimiter) StartSweeper(interval, maxIdle time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.Sweep(maxIdle)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// rateLimitKey aggregates a client address down to a /24 (IPv4) or /56
+// (IPv6) so that nearby addresses share one bucket.
+func rateLimitKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(56, 128)).String()
+}
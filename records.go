@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultRecordTTL is used for a static record entry that doesn't set ttl.
+const defaultRecordTTL = 300
+
+// maxCNAMEDepth bounds how far Lookup will follow a chain of CNAME records
+// before giving up, guarding against a misconfigured or circular chain.
+const maxCNAMEDepth = 8
+
+// RecordStore is the compiled, queryable form of RecordsConfig: every zone
+// name is normalized (lowercased, no trailing dot) and, when AutoPTR is
+// enabled, synthesized PTR entries for each A/AAAA value have been folded
+// in alongside whatever was explicitly configured.
+type RecordStore struct {
+	zones map[string][]RecordEntry
+}
+
+// BuildRecordStore compiles cfg into a RecordStore, generating reverse PTR
+// entries for every A/AAAA record when cfg.AutoPTR is set.
+func BuildRecordStore(cfg RecordsConfig) *RecordStore {
+	s := &RecordStore{zones: make(map[string][]RecordEntry, len(cfg.Zones))}
+	for name, entries := range cfg.Zones {
+		s.zones[normalizeDomain(name)] = entries
+	}
+
+	if cfg.AutoPTR {
+		for name, entries := range cfg.Zones {
+			fqdn := dns.Fqdn(name)
+			for _, e := range entries {
+				if !strings.EqualFold(e.Type, "A") && !strings.EqualFold(e.Type, "AAAA") {
+					continue
+				}
+				arpa, err := dns.ReverseAddr(e.Value)
+				if err != nil {
+					log.Printf("Skipping auto_ptr for %s -> %s: %v", name, e.Value, err)
+					continue
+				}
+				key := normalizeDomain(arpa)
+				s.zones[key] = append(s.zones[key], RecordEntry{Type: "PTR", Value: fqdn, TTL: e.TTL})
+			}
+		}
+	}
+
+	return s
+}
+
+// Lookup answers qname/qtype from the static records, following a CNAME
+// chain (up to maxCNAMEDepth) when the zone defines one but no record of
+// qtype directly. It reports ok=false when qname isn't defined in the
+// store, when the name (or a name along the chain) has neither a record of
+// qtype nor a CNAME to follow, or when the chain exceeds maxCNAMEDepth.
+// If a CNAME chain steps outside the store before resolving
+// qtype, ok is true, answer holds the CNAME record(s) built so far, and
+// externalTarget names the chain's final, unresolved name so the caller
+// can continue resolution (e.g. relay it upstream) instead of the chain
+// being silently dropped.
+func (s *RecordStore) Lookup(qname string, qtype uint16) (answer []dns.RR, externalTarget string, ok bool) {
+	ok = s.lookup(qname, qtype, 0, &answer, &externalTarget)
+	return answer, externalTarget, ok
+}
+
+func (s *RecordStore) lookup(qname string, qtype uint16, depth int, answer *[]dns.RR, externalTarget *string) bool {
+	if depth > maxCNAMEDepth {
+		log.Printf("CNAME chain for %s exceeded max depth %d, giving up", qname, maxCNAMEDepth)
+		return false
+	}
+
+	entries, ok := s.zones[normalizeDomain(qname)]
+	if !ok {
+		if depth > 0 {
+			// The chain stepped outside the local store; hand the
+			// already-built CNAME(s) back along with the remaining name
+			// so the caller can resolve it itself.
+			*externalTarget = dns.Fqdn(qname)
+			return true
+		}
+		return false
+	}
+
+	matched := false
+	for _, e := range entries {
+		if strings.EqualFold(e.Type, dns.TypeToString[qtype]) {
+			rr, err := buildRR(qname, e)
+			if err != nil {
+				log.Printf("Error building %s record for %s: %v", e.Type, qname, err)
+				continue
+			}
+			*answer = append(*answer, rr)
+			matched = true
+		}
+	}
+	if matched || qtype == dns.TypeCNAME {
+		return matched
+	}
+
+	// No direct match: if this zone defines a CNAME, follow it and keep
+	// looking for qtype at the chain target.
+	for _, e := range entries {
+		if !strings.EqualFold(e.Type, "CNAME") {
+			continue
+		}
+		rr, err := buildRR(qname, e)
+		if err != nil {
+			log.Printf("Error building CNAME record for %s: %v", qname, err)
+			return false
+		}
+		*answer = append(*answer, rr)
+		return s.lookup(e.Value, qtype, depth+1, answer, externalTarget)
+	}
+
+	return false
+}
+
+// buildRR renders a single configured RecordEntry as the dns.RR for name,
+// filling in defaultRecordTTL when the entry doesn't set one.
+func buildRR(name string, e RecordEntry) (dns.RR, error) {
+	ttl := e.TTL
+	if ttl <= 0 {
+		ttl = defaultRecordTTL
+	}
+	name = dns.Fqdn(name)
+	rtype := strings.ToUpper(e.Type)
+
+	switch rtype {
+	case "A", "AAAA":
+		return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, rtype, e.Value))
+	case "CNAME", "PTR":
+		return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, rtype, dns.Fqdn(e.Value)))
+	case "TXT":
+		return dns.NewRR(fmt.Sprintf("%s %d IN TXT %q", name, ttl, e.Value))
+	case "MX":
+		return dns.NewRR(fmt.Sprintf("%s %d IN MX %d %s", name, ttl, e.Priority, dns.Fqdn(e.Value)))
+	case "SRV":
+		return dns.NewRR(fmt.Sprintf("%s %d IN SRV %d %d %d %s", name, ttl, e.Priority, e.Weight, e.Port, dns.Fqdn(e.Value)))
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", e.Type)
+	}
+}
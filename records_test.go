@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordStoreLookup(t *testing.T) {
+	cfg := RecordsConfig{
+		AutoPTR: true,
+		Zones: map[string][]RecordEntry{
+			"foo.local": {
+				{Type: "A", Value: "10.0.0.1"},
+				{Type: "AAAA", Value: "fd00::1"},
+				{Type: "TXT", Value: "v=spf1 -all"},
+			},
+			"alias.local": {
+				{Type: "CNAME", Value: "foo.local"},
+			},
+			"external.local": {
+				{Type: "CNAME", Value: "realhost.example.com"},
+			},
+			"chain.local": {
+				{Type: "CNAME", Value: "alias.local"},
+			},
+		},
+	}
+	s := BuildRecordStore(cfg)
+
+	t.Run("direct A match", func(t *testing.T) {
+		answer, external, ok := s.Lookup("foo.local.", dns.TypeA)
+		if !ok || external != "" {
+			t.Fatalf("Lookup() = (ok=%v external=%q), want (true, \"\")", ok, external)
+		}
+		if len(answer) != 1 || answer[0].(*dns.A).A.String() != "10.0.0.1" {
+			t.Errorf("answer = %v, want a single A 10.0.0.1", answer)
+		}
+	})
+
+	t.Run("name is looked up case-insensitively", func(t *testing.T) {
+		if _, _, ok := s.Lookup("FOO.local.", dns.TypeA); !ok {
+			t.Error("Lookup() with mixed-case name = false, want true")
+		}
+	})
+
+	t.Run("CNAME resolved within the local store", func(t *testing.T) {
+		answer, external, ok := s.Lookup("alias.local.", dns.TypeA)
+		if !ok || external != "" {
+			t.Fatalf("Lookup() = (ok=%v external=%q), want (true, \"\")", ok, external)
+		}
+		if len(answer) != 2 {
+			t.Fatalf("answer = %v, want [CNAME, A]", answer)
+		}
+		if _, isCNAME := answer[0].(*dns.CNAME); !isCNAME {
+			t.Errorf("answer[0] = %T, want *dns.CNAME", answer[0])
+		}
+		if _, isA := answer[1].(*dns.A); !isA {
+			t.Errorf("answer[1] = %T, want *dns.A", answer[1])
+		}
+	})
+
+	t.Run("multi-hop CNAME chain resolved within the local store", func(t *testing.T) {
+		answer, external, ok := s.Lookup("chain.local.", dns.TypeA)
+		if !ok || external != "" {
+			t.Fatalf("Lookup() = (ok=%v external=%q), want (true, \"\")", ok, external)
+		}
+		if len(answer) != 3 {
+			t.Fatalf("answer = %v, want [CNAME, CNAME, A]", answer)
+		}
+	})
+
+	t.Run("CNAME to a name outside the store reports the external target instead of dropping the chain", func(t *testing.T) {
+		answer, external, ok := s.Lookup("external.local.", dns.TypeA)
+		if !ok {
+			t.Fatalf("Lookup() ok = false, want true (CNAME chain should not be silently discarded)")
+		}
+		if external != "realhost.example.com." {
+			t.Errorf("externalTarget = %q, want %q", external, "realhost.example.com.")
+		}
+		if len(answer) != 1 {
+			t.Fatalf("answer = %v, want the CNAME record for the local alias", answer)
+		}
+		if _, isCNAME := answer[0].(*dns.CNAME); !isCNAME {
+			t.Errorf("answer[0] = %T, want *dns.CNAME", answer[0])
+		}
+	})
+
+	t.Run("auto_ptr synthesizes a reverse record for an A entry", func(t *testing.T) {
+		answer, external, ok := s.Lookup("1.0.0.10.in-addr.arpa.", dns.TypePTR)
+		if !ok || external != "" {
+			t.Fatalf("Lookup() = (ok=%v external=%q), want (true, \"\")", ok, external)
+		}
+		if len(answer) != 1 {
+			t.Fatalf("answer = %v, want a single PTR record", answer)
+		}
+		ptr, isPTR := answer[0].(*dns.PTR)
+		if !isPTR {
+			t.Fatalf("answer[0] = %T, want *dns.PTR", answer[0])
+		}
+		if ptr.Ptr != "foo.local." {
+			t.Errorf("PTR target = %q, want %q", ptr.Ptr, "foo.local.")
+		}
+	})
+
+	t.Run("unknown name is not found", func(t *testing.T) {
+		if _, _, ok := s.Lookup("nowhere.local.", dns.TypeA); ok {
+			t.Error("Lookup() for an unconfigured name = true, want false")
+		}
+	})
+}
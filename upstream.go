@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a resolver capable of answering a DNS query over some
+// transport (plain UDP/TCP, DNS-over-TLS, or DNS-over-HTTPS).
+type Upstream interface {
+	// Exchange sends req upstream and returns the response.
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+	// Address returns a normalized form of the address this upstream was
+	// built from ("scheme://host:port", or the DoH URL), used for logging
+	// and health tracking.
+	Address() string
+}
+
+const dialTimeout = 5 * time.Second
+
+// AddressToUpstream parses addr (e.g. "udp://1.1.1.1:53", "tcp://8.8.8.8",
+// "tls://1.1.1.1:853", "https://cloudflare-dns.com/dns-query", or a bare
+// "host:port"/"host" which is treated as plain UDP on port 53) and returns
+// an Upstream for it. bootstrap is an optional "host:port" plain DNS
+// resolver used to resolve hostnames found in tls:// and https:// URLs
+// before dialing; if empty, the system resolver is used.
+func AddressToUpstream(addr string, bootstrap string) (Upstream, error) {
+	scheme, rest, hasScheme := strings.Cut(addr, "://")
+	if !hasScheme {
+		// Bare "host" or "host:port" -- treat as plain UDP, default port 53.
+		return newUpstreamPlain("udp", ensurePort(addr, "53")), nil
+	}
+
+	switch scheme {
+	case "udp":
+		return newUpstreamPlain("udp", ensurePort(rest, "53")), nil
+	case "tcp":
+		return newUpstreamPlain("tcp", ensurePort(rest, "53")), nil
+	case "tls":
+		host, port, err := net.SplitHostPort(rest)
+		if err != nil {
+			host, port = rest, "853"
+		}
+		return newUpstreamDoT(host, port, bootstrap), nil
+	case "https":
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DoH address %q: %w", addr, err)
+		}
+		return newUpstreamDoH(u, bootstrap), nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q in %q", scheme, addr)
+	}
+}
+
+func ensurePort(hostport, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(hostport, defaultPort)
+}
+
+// bootstrapResolve resolves host to an IPv4 address using the bootstrap DNS
+// server (if set) and returns that address, without a port. If bootstrap is
+// empty, host is already an IP, or the lookup fails, host is returned
+// unchanged and normal system resolution applies.
+func bootstrapResolve(host, bootstrap string) string {
+	if bootstrap == "" || net.ParseIP(host) != nil {
+		return host
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	c := &dns.Client{Timeout: dialTimeout}
+	in, _, err := c.Exchange(m, ensurePort(bootstrap, "53"))
+	if err != nil || len(in.Answer) == 0 {
+		log.Printf("Bootstrap resolve of %s via %s failed: %v", host, bootstrap, err)
+		return host
+	}
+	for _, rr := range in.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String()
+		}
+	}
+	return host
+}
+
+// upstreamPlain is a classic UDP/TCP upstream using *dns.Client.
+type upstreamPlain struct {
+	net  string
+	addr string
+}
+
+func newUpstreamPlain(network, addr string) *upstreamPlain {
+	return &upstreamPlain{net: network, addr: addr}
+}
+
+func (u *upstreamPlain) Address() string { return u.net + "://" + u.addr }
+
+func (u *upstreamPlain) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Net: u.net, Timeout: dialTimeout}
+	in, _, err := c.ExchangeContext(ctx, req, u.addr)
+	return in, err
+}
+
+// upstreamDoT implements DNS-over-TLS (RFC 7858) using a persistent,
+// reusable TLS connection guarded by a mutex.
+type upstreamDoT struct {
+	host      string
+	port      string
+	bootstrap string
+
+	mu   sync.Mutex
+	conn *tls.Conn
+}
+
+func newUpstreamDoT(host, port, bootstrap string) *upstreamDoT {
+	return &upstreamDoT{host: host, port: port, bootstrap: bootstrap}
+}
+
+func (u *upstreamDoT) Address() string { return "tls://" + net.JoinHostPort(u.host, u.port) }
+
+func (u *upstreamDoT) dial(ctx context.Context) (*tls.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	resolved := bootstrapResolve(u.host, u.bootstrap)
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(resolved, u.port))
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: u.host})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (u *upstreamDoT) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	reused := u.conn != nil
+	if u.conn == nil {
+		c, err := u.dial(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("dot: dial %s: %w", u.Address(), err)
+		}
+		u.conn = c
+	}
+
+	in, err := exchangeOnConn(u.conn, req, u.Address())
+	if err == nil {
+		return in, nil
+	}
+
+	u.conn.Close()
+	u.conn = nil
+
+	if !reused {
+		// The connection was already freshly dialed this call; retrying
+		// would just hit the same failure.
+		return nil, err
+	}
+
+	// The persistent connection was likely stale (e.g. closed by the
+	// upstream after an idle timeout between queries); re-dial once and
+	// retry before giving up.
+	c, dialErr := u.dial(ctx)
+	if dialErr != nil {
+		return nil, fmt.Errorf("dot: redial %s after %v: %w", u.Address(), err, dialErr)
+	}
+	u.conn = c
+
+	in, err = exchangeOnConn(u.conn, req, u.Address())
+	if err != nil {
+		u.conn.Close()
+		u.conn = nil
+		return nil, err
+	}
+	return in, nil
+}
+
+// exchangeOnConn writes req to conn and reads the reply, enforcing
+// dialTimeout on both halves.
+func exchangeOnConn(conn *tls.Conn, req *dns.Msg, addr string) (*dns.Msg, error) {
+	dc := &dns.Conn{Conn: conn}
+	dc.SetWriteDeadline(time.Now().Add(dialTimeout))
+	if err := dc.WriteMsg(req); err != nil {
+		return nil, fmt.Errorf("dot: write to %s: %w", addr, err)
+	}
+
+	dc.SetReadDeadline(time.Now().Add(dialTimeout))
+	in, err := dc.ReadMsg()
+	if err != nil {
+		return nil, fmt.Errorf("dot: read from %s: %w", addr, err)
+	}
+	return in, nil
+}
+
+// upstreamDoH implements DNS-over-HTTPS (RFC 8484) using POST wire-format,
+// reusing a single http.Client (and its HTTP/2 keepalive connections) per
+// upstream.
+type upstreamDoH struct {
+	url    string
+	client *http.Client
+}
+
+func newUpstreamDoH(u *url.URL, bootstrap string) *upstreamDoH {
+	host := u.Hostname()
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				port = "443"
+			}
+			resolved := bootstrapResolve(host, bootstrap)
+			return (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, network, net.JoinHostPort(resolved, port))
+		},
+		TLSClientConfig:   &tls.Config{ServerName: host},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+	return &upstreamDoH{
+		url:    u.String(),
+		client: &http.Client{Transport: transport, Timeout: dialTimeout},
+	}
+}
+
+func (u *upstreamDoH) Address() string { return u.url }
+
+// upstreamHealth tracks a simple EWMA of an upstream's recent error rate so
+// that consistently-failing upstreams can be skipped for a cooldown period
+// instead of being raced on every query.
+type upstreamHealth struct {
+	mu            sync.Mutex
+	errorEWMA     float64
+	cooldownUntil time.Time
+}
+
+const (
+	healthEWMAAlpha    = 0.2
+	healthErrorThresh  = 0.8
+	healthCooldownTime = 30 * time.Second
+)
+
+func (h *upstreamHealth) recordResult(success bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sample := 0.0
+	if !success {
+		sample = 1.0
+	}
+	h.errorEWMA = healthEWMAAlpha*sample + (1-healthEWMAAlpha)*h.errorEWMA
+
+	if h.errorEWMA >= healthErrorThresh {
+		h.cooldownUntil = time.Now().Add(healthCooldownTime)
+	}
+}
+
+// inCooldown reports whether this upstream should currently be skipped.
+func (h *upstreamHealth) inCooldown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().Before(h.cooldownUntil)
+}
+
+var (
+	healthRegistryMu sync.Mutex
+	healthRegistry   = make(map[string]*upstreamHealth)
+)
+
+// healthFor returns the shared health tracker for the upstream at addr,
+// creating one on first use.
+func healthFor(addr string) *upstreamHealth {
+	healthRegistryMu.Lock()
+	defer healthRegistryMu.Unlock()
+
+	h, ok := healthRegistry[addr]
+	if !ok {
+		h = &upstreamHealth{}
+		healthRegistry[addr] = h
+	}
+	return h
+}
+
+func (u *upstreamDoH) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("doh: pack query: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, fmt.Errorf("doh: build request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("doh: request to %s: %w", u.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s returned status %d", u.url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("doh: read response from %s: %w", u.url, err)
+	}
+
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, fmt.Errorf("doh: unpack response from %s: %w", u.url, err)
+	}
+	return in, nil
+}